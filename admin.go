@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// AdminServer exposes the ConfigManager over HTTP on its own listener, so
+// reloads and backend changes never share a port (or a mux) with proxied
+// traffic.
+type AdminServer struct {
+	manager *ConfigManager
+}
+
+// NewAdminServer creates an AdminServer backed by manager
+func NewAdminServer(manager *ConfigManager) *AdminServer {
+	return &AdminServer{manager: manager}
+}
+
+// Handler builds the admin API's http.Handler
+func (a *AdminServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/reload", a.handleReload)
+	mux.HandleFunc("/admin/backends", a.handleAddBackend)
+	mux.HandleFunc("/admin/backends/", a.handleRemoveBackend)
+	mux.HandleFunc("/admin/status", a.handleStatus)
+	return mux
+}
+
+// ListenAndServe starts the admin API on addr
+func (a *AdminServer) ListenAndServe(addr string) error {
+	server := http.Server{Addr: addr, Handler: a.Handler()}
+	return server.ListenAndServe()
+}
+
+func (a *AdminServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := a.manager.Reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// addBackendRequest is the POST /admin/backends body
+type addBackendRequest struct {
+	Host    string        `json:"host"`
+	Backend BackendConfig `json:"backend"`
+}
+
+func (a *AdminServer) handleAddBackend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req addBackendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := a.manager.AddBackend(req.Host, req.Backend); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleRemoveBackend implements DELETE /admin/backends/{url}?host={host}.
+// The backend URL is percent-encoded in the path since it may itself
+// contain a scheme, host and port.
+func (a *AdminServer) handleRemoveBackend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	encoded := strings.TrimPrefix(r.URL.Path, "/admin/backends/")
+	backendURL, err := url.QueryUnescape(encoded)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	host := r.URL.Query().Get("host")
+	if host == "" {
+		host = "default"
+	}
+
+	if err := a.manager.RemoveBackend(host, backendURL); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (a *AdminServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(a.manager.Status())
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Backend holds the data about a server
+type Backend struct {
+	URL          *url.URL
+	Weight       int
+	Alive        bool
+	mux          sync.RWMutex
+	ReverseProxy *httputil.ReverseProxy
+	connections  int64
+	healthCheck  healthCheckSettings
+
+	failureMux         sync.Mutex
+	failureCount       int
+	failureWindowStart time.Time
+}
+
+// SetWeight updates this backend's weight, as used by
+// WeightedRoundRobinPolicy, so a config reload can reweight a backend
+// without disturbing its in-flight requests.
+func (b *Backend) SetWeight(weight int) {
+	b.mux.Lock()
+	b.Weight = weight
+	b.mux.Unlock()
+}
+
+// GetWeight returns this backend's current weight
+func (b *Backend) GetWeight() int {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.Weight
+}
+
+// SetAlive for this backend
+func (b *Backend) SetAlive(alive bool) {
+	b.mux.Lock()
+	b.Alive = alive
+	b.mux.Unlock()
+}
+
+// IsAlive returns true when backend is alive
+func (b *Backend) IsAlive() (alive bool) {
+	b.mux.RLock()
+	alive = b.Alive
+	b.mux.RUnlock()
+	return
+}
+
+// IncrementConnections records a new in-flight request being proxied to this backend
+func (b *Backend) IncrementConnections() {
+	atomic.AddInt64(&b.connections, 1)
+}
+
+// DecrementConnections records an in-flight request finishing
+func (b *Backend) DecrementConnections() {
+	atomic.AddInt64(&b.connections, -1)
+}
+
+// ActiveConnections returns the number of requests currently being proxied to this backend
+func (b *Backend) ActiveConnections() int64 {
+	return atomic.LoadInt64(&b.connections)
+}
+
+// RecordFailure counts a proxy failure towards the passive circuit breaker.
+// If threshold consecutive failures land within window, the backend is
+// marked dead and RecordFailure reports true; the active HealthChecker is
+// responsible for restoring it once a probe succeeds again.
+func (b *Backend) RecordFailure(threshold int, window time.Duration) bool {
+	b.failureMux.Lock()
+	defer b.failureMux.Unlock()
+
+	now := time.Now()
+	if b.failureCount == 0 || now.Sub(b.failureWindowStart) > window {
+		b.failureWindowStart = now
+		b.failureCount = 0
+	}
+	b.failureCount++
+
+	if b.failureCount >= threshold {
+		b.SetAlive(false)
+		return true
+	}
+	return false
+}
+
+// RecordSuccess resets the passive circuit breaker's failure count
+func (b *Backend) RecordSuccess() {
+	b.failureMux.Lock()
+	b.failureCount = 0
+	b.failureMux.Unlock()
+}
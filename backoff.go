@@ -0,0 +1,109 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// BackoffConfig configures the exponential backoff used between proxy
+// retries against the same backend. Durations are expressed in
+// milliseconds since encoding/json has no native time.Duration support.
+type BackoffConfig struct {
+	InitialIntervalMs   int     `json:"initial_interval_ms"`
+	MaxIntervalMs       int     `json:"max_interval_ms"`
+	Multiplier          float64 `json:"multiplier"`
+	RandomizationFactor float64 `json:"randomization_factor"`
+	MaxElapsedMs        int     `json:"max_elapsed_ms"`
+}
+
+// BackoffSettings is the resolved, defaulted form of BackoffConfig.
+type BackoffSettings struct {
+	InitialInterval     time.Duration
+	MaxInterval         time.Duration
+	Multiplier          float64
+	RandomizationFactor float64
+	MaxElapsed          time.Duration
+}
+
+const (
+	defaultInitialInterval     = 50 * time.Millisecond
+	defaultMaxInterval         = 5 * time.Second
+	defaultMultiplier          = 2.0
+	defaultRandomizationFactor = 0.2
+	defaultMaxElapsed          = 10 * time.Second
+)
+
+// ResolveBackoffSettings fills in defaults for any unset fields. cfg may be nil.
+func ResolveBackoffSettings(cfg *BackoffConfig) BackoffSettings {
+	settings := BackoffSettings{
+		InitialInterval:     defaultInitialInterval,
+		MaxInterval:         defaultMaxInterval,
+		Multiplier:          defaultMultiplier,
+		RandomizationFactor: defaultRandomizationFactor,
+		MaxElapsed:          defaultMaxElapsed,
+	}
+	if cfg == nil {
+		return settings
+	}
+	if cfg.InitialIntervalMs > 0 {
+		settings.InitialInterval = time.Duration(cfg.InitialIntervalMs) * time.Millisecond
+	}
+	if cfg.MaxIntervalMs > 0 {
+		settings.MaxInterval = time.Duration(cfg.MaxIntervalMs) * time.Millisecond
+	}
+	if cfg.Multiplier > 0 {
+		settings.Multiplier = cfg.Multiplier
+	}
+	if cfg.RandomizationFactor > 0 {
+		settings.RandomizationFactor = cfg.RandomizationFactor
+	}
+	if cfg.MaxElapsedMs > 0 {
+		settings.MaxElapsed = time.Duration(cfg.MaxElapsedMs) * time.Millisecond
+	}
+	return settings
+}
+
+// BackoffState tracks per-request exponential backoff progress. It is
+// created on the first proxy failure and threaded through retries via the
+// request context.
+type BackoffState struct {
+	interval  time.Duration
+	startedAt time.Time
+}
+
+// NewBackoffState starts a fresh backoff sequence using settings
+func NewBackoffState(settings BackoffSettings) *BackoffState {
+	return &BackoffState{
+		interval:  settings.InitialInterval,
+		startedAt: time.Now(),
+	}
+}
+
+// Next returns the delay to wait before the next retry and whether the
+// caller is still within MaxElapsed. Once the budget is exhausted it
+// returns false and the caller should stop retrying this backend.
+func (s *BackoffState) Next(settings BackoffSettings) (time.Duration, bool) {
+	if settings.MaxElapsed > 0 && time.Since(s.startedAt) >= settings.MaxElapsed {
+		return 0, false
+	}
+
+	delay := withJitter(s.interval, settings.RandomizationFactor)
+
+	s.interval = time.Duration(float64(s.interval) * settings.Multiplier)
+	if s.interval > settings.MaxInterval {
+		s.interval = settings.MaxInterval
+	}
+
+	return delay, true
+}
+
+// withJitter randomizes interval by up to +/-factor to avoid retry storms
+func withJitter(interval time.Duration, factor float64) time.Duration {
+	if factor <= 0 {
+		return interval
+	}
+	delta := factor * float64(interval)
+	min := float64(interval) - delta
+	max := float64(interval) + delta
+	return time.Duration(min + rand.Float64()*(max-min))
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+)
+
+// BackendConfig describes a single upstream in config.json
+type BackendConfig struct {
+	URL         string             `json:"url"`
+	Weight      int                `json:"weight"`
+	HealthCheck *HealthCheckConfig `json:"health_check"`
+
+	// Retries, DelayMs and TimeoutMs override this backend's retry count,
+	// initial backoff delay, and response timeout respectively. For a
+	// fcgi:// backend TimeoutMs bounds only the connection dial; the wait
+	// for its response is not bounded.
+	Retries   int `json:"retries"`
+	DelayMs   int `json:"delay_ms"`
+	TimeoutMs int `json:"timeout_ms"`
+
+	// ScriptFilename is passed to a fcgi:// backend as SCRIPT_FILENAME; it
+	// is ignored for plain HTTP backends.
+	ScriptFilename string `json:"script_filename"`
+}
+
+const fcgiScheme = "fcgi"
+
+// RouteConfig describes one virtual host's backend pool
+type RouteConfig struct {
+	Backends []BackendConfig `json:"backends"`
+	Policy   string          `json:"policy"`
+}
+
+// Config holds the configuration read from file
+type Config struct {
+	Port   int                    `json:"port"`
+	Routes map[string]RouteConfig `json:"routes"`
+
+	// PassiveFailureThreshold is how many consecutive proxy failures within
+	// PassiveFailureWindowSeconds trip a backend's circuit breaker.
+	PassiveFailureThreshold     int `json:"passive_failure_threshold"`
+	PassiveFailureWindowSeconds int `json:"passive_failure_window_seconds"`
+
+	// Backoff configures the retry backoff used against a failing backend.
+	Backoff *BackoffConfig `json:"backoff"`
+
+	// AdminPort serves the hot-reload admin API (see AdminServer), separate
+	// from the load-balanced Port.
+	AdminPort int `json:"admin_port"`
+
+	// ConfigPollSeconds controls how often config.json is checked for
+	// changes; 0 uses defaultConfigPollInterval.
+	ConfigPollSeconds int `json:"config_poll_seconds"`
+}
+
+const (
+	defaultPassiveFailureThreshold = 5
+	defaultPassiveFailureWindow    = 30 * time.Second
+	defaultBackendRetries          = 3
+	defaultBackendTimeout          = 10 * time.Second
+	defaultAdminPort               = 9090
+	defaultPort                    = 3030
+)
+
+// globalSettings are the parts of Config that apply pool-wide rather than
+// per backend, resolved once and threaded through backend construction.
+type globalSettings struct {
+	passiveThreshold int
+	passiveWindow    time.Duration
+	backoff          BackoffSettings
+}
+
+func resolveGlobalSettings(config Config) globalSettings {
+	passiveThreshold := config.PassiveFailureThreshold
+	if passiveThreshold <= 0 {
+		passiveThreshold = defaultPassiveFailureThreshold
+	}
+	passiveWindow := defaultPassiveFailureWindow
+	if config.PassiveFailureWindowSeconds > 0 {
+		passiveWindow = time.Duration(config.PassiveFailureWindowSeconds) * time.Second
+	}
+	return globalSettings{
+		passiveThreshold: passiveThreshold,
+		passiveWindow:    passiveWindow,
+		backoff:          ResolveBackoffSettings(config.Backoff),
+	}
+}
+
+// buildBackend wires up a Backend's ReverseProxy, applying any per-backend
+// retries/delay overrides to its ErrorHandler and the timeout override to
+// its Transport, and registers it with hc for active health checking.
+func buildBackend(backendConfig BackendConfig, settings globalSettings, hc *HealthChecker) (*Backend, error) {
+	serverURL, err := url.Parse(backendConfig.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	weight := backendConfig.Weight
+	if weight <= 0 {
+		weight = 1
+	}
+
+	maxRetries := backendConfig.Retries
+	if maxRetries <= 0 {
+		maxRetries = defaultBackendRetries
+	}
+
+	timeout := defaultBackendTimeout
+	if backendConfig.TimeoutMs > 0 {
+		timeout = time.Duration(backendConfig.TimeoutMs) * time.Millisecond
+	}
+
+	backoffSettings := settings.backoff
+	if backendConfig.DelayMs > 0 {
+		backoffSettings.InitialInterval = time.Duration(backendConfig.DelayMs) * time.Millisecond
+	}
+
+	backend := &Backend{
+		URL:         serverURL,
+		Weight:      weight,
+		Alive:       true,
+		healthCheck: resolveHealthCheckSettings(backendConfig.HealthCheck),
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(serverURL)
+	if serverURL.Scheme == fcgiScheme {
+		proxy.Transport = NewFCGITransport(serverURL.Host, backendConfig.ScriptFilename, timeout)
+	} else {
+		proxy.Transport = &http.Transport{ResponseHeaderTimeout: timeout}
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		// ErrorHandler only sees connection/transport failures; a backend
+		// that answers with 5xx never calls it, so feed the breaker here too.
+		if resp.StatusCode >= http.StatusInternalServerError {
+			backend.RecordFailure(settings.passiveThreshold, settings.passiveWindow)
+		} else {
+			backend.RecordSuccess()
+		}
+		return nil
+	}
+	proxy.ErrorHandler = func(writer http.ResponseWriter, request *http.Request, e error) {
+		log.Printf("[%s] %s\n", serverURL.Host, e.Error())
+
+		// a real circuit breaker: repeated failures within a window trip
+		// the backend, the active HealthChecker restores it once probes
+		// succeed again
+		backend.RecordFailure(settings.passiveThreshold, settings.passiveWindow)
+
+		retries := GetRetryFromContext(request)
+		if retries < maxRetries {
+			state, ok := request.Context().Value(backoffKey).(*BackoffState)
+			if !ok || state == nil {
+				state = NewBackoffState(backoffSettings)
+			}
+			if delay, withinBudget := state.Next(backoffSettings); withinBudget {
+				select {
+				case <-request.Context().Done():
+					// client gave up, don't waste a retry on it
+					return
+				case <-time.After(delay):
+				}
+
+				ctx := context.WithValue(request.Context(), retryKey, retries+1)
+				ctx = context.WithValue(ctx, backoffKey, state)
+				proxy.ServeHTTP(writer, request.WithContext(ctx))
+				return
+			}
+		}
+
+		// out of retries (or backoff budget) against this backend, try another one
+		attempts := GetAttemptsFromContext(request)
+		log.Printf("%s(%s) Attempting retry %d\n", request.RemoteAddr, request.URL.Path, attempts)
+		ctx := context.WithValue(request.Context(), attemptsKey, attempts+1)
+		// the next backend starts with its own retry count and backoff
+		ctx = context.WithValue(ctx, retryKey, 0)
+		ctx = context.WithValue(ctx, backoffKey, (*BackoffState)(nil))
+		lb(writer, request.WithContext(ctx))
+	}
+	backend.ReverseProxy = proxy
+
+	hc.Watch(backend)
+
+	return backend, nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	defaultConfigPollInterval = 5 * time.Second
+	defaultDrainTimeout       = 30 * time.Second
+)
+
+// ConfigManager owns the live Config, reloading it from disk whenever it
+// changes and diffing the new backend set against the running Router so
+// unaffected backends are left completely undisturbed.
+type ConfigManager struct {
+	path          string
+	healthChecker *HealthChecker
+	drainTimeout  time.Duration
+
+	mux     sync.Mutex
+	router  *Router
+	current Config
+	hash    [sha256.Size]byte
+}
+
+// NewConfigManager loads path once to build the initial router, then
+// returns a manager ready to watch for further changes.
+func NewConfigManager(path string, hc *HealthChecker) (*ConfigManager, error) {
+	cm := &ConfigManager{
+		path:          path,
+		healthChecker: hc,
+		drainTimeout:  defaultDrainTimeout,
+		router:        NewRouter(),
+	}
+	if err := cm.reloadFromDisk(); err != nil {
+		return nil, err
+	}
+	return cm, nil
+}
+
+// Router returns the currently active Router
+func (cm *ConfigManager) Router() *Router {
+	cm.mux.Lock()
+	defer cm.mux.Unlock()
+	return cm.router
+}
+
+// CurrentConfig returns the most recently applied Config
+func (cm *ConfigManager) CurrentConfig() Config {
+	cm.mux.Lock()
+	defer cm.mux.Unlock()
+	return cm.current
+}
+
+// Watch polls path for changes every pollInterval until stop is closed
+func (cm *ConfigManager) Watch(pollInterval time.Duration, stop <-chan struct{}) {
+	if pollInterval <= 0 {
+		pollInterval = defaultConfigPollInterval
+	}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			changed, err := cm.fileChanged()
+			if err != nil {
+				log.Printf("config watch: %v\n", err)
+				continue
+			}
+			if !changed {
+				continue
+			}
+			log.Println("config.json changed, reloading...")
+			if err := cm.Reload(); err != nil {
+				log.Printf("config reload failed: %v\n", err)
+			}
+		}
+	}
+}
+
+func (cm *ConfigManager) fileChanged() (bool, error) {
+	data, err := ioutil.ReadFile(cm.path)
+	if err != nil {
+		return false, err
+	}
+	sum := sha256.Sum256(data)
+	cm.mux.Lock()
+	defer cm.mux.Unlock()
+	return sum != cm.hash, nil
+}
+
+func (cm *ConfigManager) reloadFromDisk() error {
+	data, err := ioutil.ReadFile(cm.path)
+	if err != nil {
+		return err
+	}
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+	return cm.apply(config, sha256.Sum256(data))
+}
+
+// Reload re-reads path from disk and applies whatever changed
+func (cm *ConfigManager) Reload() error {
+	return cm.reloadFromDisk()
+}
+
+// apply diffs newConfig's routes against the running router, matching
+// backends by URL: a backend that is still listed keeps running and only
+// its weight is updated (its other settings are not re-read), new backends
+// are added and health-checked, and departed backends are drained before
+// being removed.
+func (cm *ConfigManager) apply(newConfig Config, hash [sha256.Size]byte) error {
+	if len(newConfig.Routes) == 0 {
+		return fmt.Errorf("please provide one or more routes to load balance")
+	}
+
+	settings := resolveGlobalSettings(newConfig)
+
+	cm.mux.Lock()
+	defer cm.mux.Unlock()
+
+	seenHosts := make(map[string]bool, len(newConfig.Routes))
+	for host, routeConfig := range newConfig.Routes {
+		seenHosts[host] = true
+		if err := cm.applyRoute(host, routeConfig, settings); err != nil {
+			return fmt.Errorf("route %q: %w", host, err)
+		}
+	}
+
+	for _, host := range cm.router.Hosts() {
+		if seenHosts[host] {
+			continue
+		}
+		pool := cm.router.RemovePool(host)
+		if pool == nil {
+			continue
+		}
+		for _, backend := range pool.Backends() {
+			go cm.drain(pool, backend)
+		}
+		log.Printf("route %q removed\n", host)
+	}
+
+	cm.current = newConfig
+	cm.hash = hash
+	return nil
+}
+
+func (cm *ConfigManager) applyRoute(host string, routeConfig RouteConfig, settings globalSettings) error {
+	if len(routeConfig.Backends) == 0 {
+		return fmt.Errorf("no backends configured")
+	}
+
+	policy, err := NewSelectionPolicy(routeConfig.Policy)
+	if err != nil {
+		return err
+	}
+
+	pool := cm.router.getPool(host)
+	if pool == nil {
+		pool = NewServerPool(policy)
+		for _, backendConfig := range routeConfig.Backends {
+			backend, err := buildBackend(backendConfig, settings, cm.healthChecker)
+			if err != nil {
+				return err
+			}
+			pool.AddBackend(backend)
+			log.Printf("[%s] Configured server: %s\n", host, backend.URL)
+		}
+		cm.router.AddPool(host, pool)
+		return nil
+	}
+
+	pool.SetPolicy(policy)
+
+	existing := make(map[string]*Backend)
+	for _, backend := range pool.Backends() {
+		existing[backend.URL.String()] = backend
+	}
+
+	wanted := make(map[string]bool, len(routeConfig.Backends))
+	for _, backendConfig := range routeConfig.Backends {
+		wanted[backendConfig.URL] = true
+
+		if backend, ok := existing[backendConfig.URL]; ok {
+			weight := backendConfig.Weight
+			if weight <= 0 {
+				weight = 1
+			}
+			backend.SetWeight(weight)
+			continue
+		}
+
+		backend, err := buildBackend(backendConfig, settings, cm.healthChecker)
+		if err != nil {
+			return err
+		}
+		pool.AddBackend(backend)
+		log.Printf("[%s] Configured server: %s\n", host, backend.URL)
+	}
+
+	for backendURL, backend := range existing {
+		if !wanted[backendURL] {
+			go cm.drain(pool, backend)
+		}
+	}
+
+	return nil
+}
+
+// drain stops routing new requests to backend, waits for its in-flight
+// requests to finish (up to drainTimeout), then stops health-checking it.
+func (cm *ConfigManager) drain(pool *ServerPool, backend *Backend) {
+	backend.SetAlive(false)
+	pool.RemoveBackend(backend.URL)
+
+	deadline := time.Now().Add(cm.drainTimeout)
+	for backend.ActiveConnections() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	cm.healthChecker.Unwatch(backend)
+	log.Printf("backend %s drained and removed\n", backend.URL)
+}
+
+// AddBackend adds a single backend to an existing route's pool, as used by
+// the admin API.
+func (cm *ConfigManager) AddBackend(host string, backendConfig BackendConfig) error {
+	cm.mux.Lock()
+	defer cm.mux.Unlock()
+
+	pool := cm.router.getPool(host)
+	if pool == nil {
+		return fmt.Errorf("no such route %q", host)
+	}
+
+	settings := resolveGlobalSettings(cm.current)
+	backend, err := buildBackend(backendConfig, settings, cm.healthChecker)
+	if err != nil {
+		return err
+	}
+	pool.AddBackend(backend)
+	log.Printf("[%s] Configured server: %s\n", host, backend.URL)
+	return nil
+}
+
+// RemoveBackend drains and removes a single backend from an existing
+// route's pool, as used by the admin API.
+func (cm *ConfigManager) RemoveBackend(host, backendURL string) error {
+	u, err := url.Parse(backendURL)
+	if err != nil {
+		return err
+	}
+
+	cm.mux.Lock()
+	pool := cm.router.getPool(host)
+	cm.mux.Unlock()
+	if pool == nil {
+		return fmt.Errorf("no such route %q", host)
+	}
+
+	backends := pool.Backends()
+	for _, backend := range backends {
+		if backend.URL.String() == u.String() {
+			go cm.drain(pool, backend)
+			return nil
+		}
+	}
+	return fmt.Errorf("no such backend %q on route %q", backendURL, host)
+}
+
+// Status is a snapshot of every route and backend for the admin status endpoint
+type Status struct {
+	Routes map[string][]BackendStatus `json:"routes"`
+}
+
+// BackendStatus reports one backend's live state
+type BackendStatus struct {
+	URL         string `json:"url"`
+	Alive       bool   `json:"alive"`
+	Weight      int    `json:"weight"`
+	Connections int64  `json:"connections"`
+}
+
+// Status snapshots every route and backend currently in the router
+func (cm *ConfigManager) Status() Status {
+	cm.mux.Lock()
+	router := cm.router
+	cm.mux.Unlock()
+
+	status := Status{Routes: make(map[string][]BackendStatus)}
+	for _, host := range router.Hosts() {
+		pool := router.getPool(host)
+		if pool == nil {
+			continue
+		}
+		backends := pool.Backends()
+		entries := make([]BackendStatus, 0, len(backends))
+		for _, b := range backends {
+			entries = append(entries, BackendStatus{
+				URL:         b.URL.String(),
+				Alive:       b.IsAlive(),
+				Weight:      b.GetWeight(),
+				Connections: b.ActiveConnections(),
+			})
+		}
+		status.Routes[host] = entries
+	}
+	return status
+}
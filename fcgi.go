@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FastCGI record types and constants, as defined by the FastCGI spec.
+const (
+	fcgiVersion1 = 1
+
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+
+	fcgiRoleResponder = 1
+	fcgiKeepConn      = 1
+)
+
+type fcgiHeader struct {
+	Version       uint8
+	Type          uint8
+	RequestID     uint16
+	ContentLength uint16
+	PaddingLength uint8
+	Reserved      uint8
+}
+
+func writeFCGIRecord(w io.Writer, recType uint8, reqID uint16, content []byte) error {
+	header := fcgiHeader{
+		Version:       fcgiVersion1,
+		Type:          recType,
+		RequestID:     reqID,
+		ContentLength: uint16(len(content)),
+	}
+	if err := binary.Write(w, binary.BigEndian, header); err != nil {
+		return err
+	}
+	_, err := w.Write(content)
+	return err
+}
+
+func encodeFCGISize(buf *bytes.Buffer, size int) {
+	if size <= 127 {
+		buf.WriteByte(byte(size))
+		return
+	}
+	var tmp [4]byte
+	binary.BigEndian.PutUint32(tmp[:], uint32(size)|0x80000000)
+	buf.Write(tmp[:])
+}
+
+// encodeFCGIParams packs the CGI env into the length-prefixed key/value
+// pairs the FASTCGI_PARAMS record expects.
+func encodeFCGIParams(params map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	for k, v := range params {
+		encodeFCGISize(buf, len(k))
+		encodeFCGISize(buf, len(v))
+		buf.WriteString(k)
+		buf.WriteString(v)
+	}
+	return buf.Bytes()
+}
+
+// fcgiResponse accumulates the STDOUT/STDERR bytes for one request ID.
+type fcgiResponse struct {
+	stdout []byte
+	stderr []byte
+	err    error
+}
+
+// fcgiClient multiplexes concurrent requests over a single persistent TCP
+// connection to a FastCGI responder (e.g. PHP-FPM), as the protocol intends.
+type fcgiClient struct {
+	addr        string
+	dialTimeout time.Duration
+
+	mux     sync.Mutex
+	conn    net.Conn
+	nextID  uint32
+	pending map[uint16]chan fcgiResponse
+
+	// writeMux serializes the BEGIN_REQUEST..STDIN record sequence of each
+	// request onto the wire so concurrent callers can't interleave their
+	// frames on the shared connection.
+	writeMux sync.Mutex
+}
+
+func newFCGIClient(addr string, dialTimeout time.Duration) *fcgiClient {
+	return &fcgiClient{
+		addr:        addr,
+		dialTimeout: dialTimeout,
+		pending:     make(map[uint16]chan fcgiResponse),
+	}
+}
+
+func (c *fcgiClient) getConn() (net.Conn, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.conn != nil {
+		return c.conn, nil
+	}
+	conn, err := net.DialTimeout("tcp", c.addr, c.dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	go c.readLoop(conn)
+	return conn, nil
+}
+
+// readLoop demultiplexes records off the shared connection by request ID
+// until the connection breaks, at which point every pending caller is
+// unblocked with an error.
+func (c *fcgiClient) readLoop(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	buffers := make(map[uint16]*fcgiResponse)
+
+	for {
+		var header fcgiHeader
+		if err := binary.Read(reader, binary.BigEndian, &header); err != nil {
+			c.abortAll(err)
+			return
+		}
+
+		content := make([]byte, header.ContentLength)
+		if _, err := io.ReadFull(reader, content); err != nil {
+			c.abortAll(err)
+			return
+		}
+		if header.PaddingLength > 0 {
+			if _, err := io.CopyN(ioutil.Discard, reader, int64(header.PaddingLength)); err != nil {
+				c.abortAll(err)
+				return
+			}
+		}
+
+		buf, ok := buffers[header.RequestID]
+		if !ok {
+			buf = &fcgiResponse{}
+			buffers[header.RequestID] = buf
+		}
+
+		switch header.Type {
+		case fcgiStdout:
+			buf.stdout = append(buf.stdout, content...)
+		case fcgiStderr:
+			buf.stderr = append(buf.stderr, content...)
+		case fcgiEndRequest:
+			c.mux.Lock()
+			ch, ok := c.pending[header.RequestID]
+			delete(c.pending, header.RequestID)
+			c.mux.Unlock()
+			if ok {
+				ch <- *buf
+			}
+			delete(buffers, header.RequestID)
+		}
+	}
+}
+
+func (c *fcgiClient) abortAll(err error) {
+	c.mux.Lock()
+	conn := c.conn
+	c.conn = nil
+	pending := c.pending
+	c.pending = make(map[uint16]chan fcgiResponse)
+	c.mux.Unlock()
+
+	if conn != nil {
+		_ = conn.Close()
+	}
+	for _, ch := range pending {
+		ch <- fcgiResponse{err: err}
+	}
+}
+
+// writeRequest emits the BEGIN_REQUEST, PARAMS and STDIN records for one
+// request as an uninterrupted sequence. writeMux is held for the duration
+// so concurrent Do calls can't interleave their records on the shared conn.
+func (c *fcgiClient) writeRequest(conn net.Conn, reqID uint16, params map[string]string, body io.Reader) error {
+	c.writeMux.Lock()
+	defer c.writeMux.Unlock()
+
+	beginBody := []byte{0, fcgiRoleResponder, fcgiKeepConn, 0, 0, 0, 0, 0}
+	if err := writeFCGIRecord(conn, fcgiBeginRequest, reqID, beginBody); err != nil {
+		return err
+	}
+
+	if paramBytes := encodeFCGIParams(params); len(paramBytes) > 0 {
+		if err := writeFCGIRecord(conn, fcgiParams, reqID, paramBytes); err != nil {
+			return err
+		}
+	}
+	if err := writeFCGIRecord(conn, fcgiParams, reqID, nil); err != nil {
+		return err
+	}
+
+	if body != nil {
+		buf := make([]byte, 32*1024)
+		for {
+			n, rerr := body.Read(buf)
+			if n > 0 {
+				if err := writeFCGIRecord(conn, fcgiStdin, reqID, buf[:n]); err != nil {
+					return err
+				}
+			}
+			if rerr == io.EOF {
+				break
+			}
+			if rerr != nil {
+				return rerr
+			}
+		}
+	}
+	return writeFCGIRecord(conn, fcgiStdin, reqID, nil)
+}
+
+// Do runs one FastCGI responder request and blocks for its result.
+func (c *fcgiClient) Do(params map[string]string, body io.Reader) (*fcgiResponse, error) {
+	conn, err := c.getConn()
+	if err != nil {
+		return nil, err
+	}
+
+	// request IDs must be non-zero
+	reqID := uint16(atomic.AddUint32(&c.nextID, 1)%0xfffe) + 1
+
+	ch := make(chan fcgiResponse, 1)
+	c.mux.Lock()
+	c.pending[reqID] = ch
+	c.mux.Unlock()
+
+	if err := c.writeRequest(conn, reqID, params, body); err != nil {
+		c.mux.Lock()
+		delete(c.pending, reqID)
+		c.mux.Unlock()
+		return nil, err
+	}
+
+	result := <-ch
+	if result.err != nil {
+		return nil, result.err
+	}
+	return &result, nil
+}
+
+// FCGITransport is an http.RoundTripper that speaks FastCGI to a single
+// upstream (typically PHP-FPM) instead of plain HTTP, so it can be dropped
+// into httputil.ReverseProxy.Transport and reuse all of the reverse proxy's
+// existing retry, backoff and error handling machinery.
+type FCGITransport struct {
+	ScriptFilename string
+	client         *fcgiClient
+}
+
+// NewFCGITransport builds a transport that multiplexes every request over
+// one persistent connection to addr (host:port), dialled on first use with
+// dialTimeout, tagging each with scriptFilename as SCRIPT_FILENAME.
+func NewFCGITransport(addr, scriptFilename string, dialTimeout time.Duration) *FCGITransport {
+	return &FCGITransport{
+		ScriptFilename: scriptFilename,
+		client:         newFCGIClient(addr, dialTimeout),
+	}
+}
+
+// RoundTrip maps req onto the CGI environment and returns the parsed response
+func (t *FCGITransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	params := map[string]string{
+		"REQUEST_METHOD":    req.Method,
+		"SCRIPT_FILENAME":   t.ScriptFilename,
+		"QUERY_STRING":      req.URL.RawQuery,
+		"REQUEST_URI":       req.URL.RequestURI(),
+		"SERVER_PROTOCOL":   req.Proto,
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"REMOTE_ADDR":       clientIP(req),
+		"SERVER_SOFTWARE":   "InBalance",
+	}
+	body := req.Body
+	switch {
+	case req.ContentLength > 0:
+		params["CONTENT_LENGTH"] = strconv.FormatInt(req.ContentLength, 10)
+	case body != nil && body != http.NoBody:
+		// ContentLength is -1 for a chunked/unknown-length body. PHP-FPM
+		// won't read STDIN without CONTENT_LENGTH, so buffer the body to
+		// learn its real length before sending it.
+		buf, err := ioutil.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		params["CONTENT_LENGTH"] = strconv.Itoa(len(buf))
+		body = ioutil.NopCloser(bytes.NewReader(buf))
+	}
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		params["CONTENT_TYPE"] = ct
+	}
+	for name, values := range req.Header {
+		key := "HTTP_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		params[key] = strings.Join(values, ", ")
+	}
+
+	result, err := t.client.Do(params, body)
+	if err != nil {
+		return nil, err
+	}
+	return parseCGIResponse(result.stdout, req)
+}
+
+// parseCGIResponse turns a FastCGI STDOUT stream (CGI-style header block
+// followed by the body) into an *http.Response.
+func parseCGIResponse(raw []byte, req *http.Request) (*http.Response, error) {
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw)))
+	mimeHeader, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	status := http.StatusOK
+	if s := mimeHeader.Get("Status"); s != "" {
+		mimeHeader.Del("Status")
+		if fields := strings.Fields(s); len(fields) > 0 {
+			if code, convErr := strconv.Atoi(fields[0]); convErr == nil {
+				status = code
+			}
+		}
+	}
+
+	// whatever ReadMIMEHeader hasn't consumed is the body
+	body, err := ioutil.ReadAll(tp.R)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		StatusCode:    status,
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header(mimeHeader),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
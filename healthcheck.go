@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthCheckConfig configures how a single backend is actively probed.
+// Leaving Path empty falls back to a plain TCP dial.
+type HealthCheckConfig struct {
+	Path              string `json:"path"`
+	Method            string `json:"method"`
+	IntervalSeconds   int    `json:"interval_seconds"`
+	TimeoutSeconds    int    `json:"timeout_seconds"`
+	ExpectedStatusMin int    `json:"expected_status_min"`
+	ExpectedStatusMax int    `json:"expected_status_max"`
+	ExpectedBody      string `json:"expected_body"`
+}
+
+// healthCheckSettings is the resolved, defaulted form of HealthCheckConfig
+// that HealthChecker actually probes with.
+type healthCheckSettings struct {
+	path              string
+	method            string
+	interval          time.Duration
+	timeout           time.Duration
+	expectedStatusMin int
+	expectedStatusMax int
+	expectedBody      string
+}
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+)
+
+// resolveHealthCheckSettings fills in defaults for any unset fields. cfg may be nil.
+func resolveHealthCheckSettings(cfg *HealthCheckConfig) healthCheckSettings {
+	settings := healthCheckSettings{
+		method:            http.MethodGet,
+		interval:          defaultHealthCheckInterval,
+		timeout:           defaultHealthCheckTimeout,
+		expectedStatusMin: 200,
+		expectedStatusMax: 399,
+	}
+	if cfg == nil {
+		return settings
+	}
+	settings.path = cfg.Path
+	if cfg.Method != "" {
+		settings.method = cfg.Method
+	}
+	if cfg.IntervalSeconds > 0 {
+		settings.interval = time.Duration(cfg.IntervalSeconds) * time.Second
+	}
+	if cfg.TimeoutSeconds > 0 {
+		settings.timeout = time.Duration(cfg.TimeoutSeconds) * time.Second
+	}
+	if cfg.ExpectedStatusMin > 0 {
+		settings.expectedStatusMin = cfg.ExpectedStatusMin
+	}
+	if cfg.ExpectedStatusMax > 0 {
+		settings.expectedStatusMax = cfg.ExpectedStatusMax
+	}
+	settings.expectedBody = cfg.ExpectedBody
+	return settings
+}
+
+// HealthChecker actively probes registered backends on their own ticker,
+// flipping Backend.Alive as probes succeed or fail. It also acts as the
+// recovery half of the passive circuit breaker: a backend tripped by
+// repeated proxy failures is restored as soon as a probe succeeds again.
+//
+// Backends can be registered and unregistered at runtime via Watch/Unwatch,
+// so a ConfigManager can add or drain backends without disturbing the
+// probing goroutines of any backend that didn't change.
+type HealthChecker struct {
+	client *http.Client
+
+	mux    sync.Mutex
+	stopFn map[*Backend]func()
+}
+
+// NewHealthChecker creates a HealthChecker with no backends registered yet
+func NewHealthChecker() *HealthChecker {
+	return &HealthChecker{
+		client: &http.Client{
+			Transport: &http.Transport{
+				MaxIdleConns:        100,
+				MaxIdleConnsPerHost: 10,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		},
+		stopFn: make(map[*Backend]func()),
+	}
+}
+
+// Watch starts probing b on its own ticker. Watching an already-watched
+// backend is a no-op.
+func (hc *HealthChecker) Watch(b *Backend) {
+	hc.mux.Lock()
+	defer hc.mux.Unlock()
+	if _, ok := hc.stopFn[b]; ok {
+		return
+	}
+	stop := make(chan struct{})
+	hc.stopFn[b] = func() { close(stop) }
+	go hc.run(b, stop)
+}
+
+// Unwatch stops probing b
+func (hc *HealthChecker) Unwatch(b *Backend) {
+	hc.mux.Lock()
+	stop, ok := hc.stopFn[b]
+	delete(hc.stopFn, b)
+	hc.mux.Unlock()
+	if ok {
+		stop()
+	}
+}
+
+// StopAll stops every probing goroutine, e.g. during shutdown
+func (hc *HealthChecker) StopAll() {
+	hc.mux.Lock()
+	stopFns := hc.stopFn
+	hc.stopFn = make(map[*Backend]func())
+	hc.mux.Unlock()
+	for _, stop := range stopFns {
+		stop()
+	}
+}
+
+func (hc *HealthChecker) run(b *Backend, stop chan struct{}) {
+	ticker := time.NewTicker(b.healthCheck.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			hc.probe(b)
+		}
+	}
+}
+
+func (hc *HealthChecker) probe(b *Backend) {
+	var alive bool
+	if b.healthCheck.path != "" {
+		alive = hc.probeHTTP(b)
+	} else {
+		alive = isBackendAlive(b.URL)
+	}
+
+	if alive != b.IsAlive() {
+		status := "down"
+		if alive {
+			status = "up"
+		}
+		log.Printf("%s [%s]\n", b.URL, status)
+	}
+
+	b.SetAlive(alive)
+	if alive {
+		b.RecordSuccess()
+	}
+}
+
+func (hc *HealthChecker) probeHTTP(b *Backend) bool {
+	settings := b.healthCheck
+
+	probeURL := *b.URL
+	probeURL.Path = settings.path
+
+	ctx, cancel := context.WithTimeout(context.Background(), settings.timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(settings.method, probeURL.String(), nil)
+	if err != nil {
+		return false
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := hc.client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < settings.expectedStatusMin || resp.StatusCode > settings.expectedStatusMax {
+		return false
+	}
+
+	if settings.expectedBody == "" {
+		return true
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false
+	}
+	return bytes.Contains(body, []byte(settings.expectedBody))
+}
@@ -1,115 +1,31 @@
 package main
 
 import (
-	"context"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
-	"sync"
-	"sync/atomic"
 	"time"
 )
 
+// contextKey namespaces the values InBalance stores on a request context
+// so they don't collide with values set by other middleware.
+type contextKey string
+
 const (
-	// Attempts is the number of attempts per backend
-	Attempts int = iota
-	// Retry is the retry state of a backend
-	Retry
+	// attemptsKey is the number of backends tried for a request
+	attemptsKey contextKey = "attempts"
+	// retryKey is the retry state of a backend
+	retryKey contextKey = "retry"
+	// backoffKey carries the in-flight *BackoffState between retries of the
+	// same backend
+	backoffKey contextKey = "backoff"
 )
 
-// Backend holds the data about a server
-type Backend struct {
-	URL          *url.URL
-	Alive        bool
-	mux          sync.RWMutex
-	ReverseProxy *httputil.ReverseProxy
-}
-
-// Config holds the configuration read from file
-type Config struct {
-	Port     int
-	Backends []string
-}
-
-// SetAlive for this backend
-func (b *Backend) SetAlive(alive bool) {
-	b.mux.Lock()
-	b.Alive = alive
-	b.mux.Unlock()
-}
-
-// IsAlive returns true when backend is alive
-func (b *Backend) IsAlive() (alive bool) {
-	b.mux.RLock()
-	alive = b.Alive
-	b.mux.RUnlock()
-	return
-}
-
-// ServerPool holds information about reachable backends
-type ServerPool struct {
-	backends []*Backend
-	current  uint64
-}
-
-// AddBackend to the server pool
-func (s *ServerPool) AddBackend(backend *Backend) {
-	s.backends = append(s.backends, backend)
-}
-
-// NextIndex atomically increase the counter and return an index
-func (s *ServerPool) NextIndex() int {
-	return int(atomic.AddUint64(&s.current, uint64(1)) % uint64(len(s.backends)))
-}
-
-// MarkBackendStatus changes a status of a backend
-func (s *ServerPool) MarkBackendStatus(backendURL *url.URL, alive bool) {
-	for _, b := range s.backends {
-		if b.URL.String() == backendURL.String() {
-			b.SetAlive(alive)
-			break
-		}
-	}
-}
-
-// GetNextPeer returns next active peer to take a connection
-func (s *ServerPool) GetNextPeer() *Backend {
-	// loop entire backends to find out an Alive backend
-	next := s.NextIndex()
-	l := len(s.backends) + next // start from next and move a full cycle
-	for i := next; i < l; i++ {
-		idx := i % len(s.backends)     // take an index by modding
-		if s.backends[idx].IsAlive() { // if we have an alive backend, use it and store if its not the original one
-			if i != next {
-				atomic.StoreUint64(&s.current, uint64(idx))
-			}
-			return s.backends[idx]
-		}
-	}
-	return nil
-}
-
-// HealthCheck pings the backends and update the status
-func (s *ServerPool) HealthCheck() {
-	for _, b := range s.backends {
-		status := "up"
-		alive := isBackendAlive(b.URL)
-		b.SetAlive(alive)
-		if !alive {
-			status = "down"
-		}
-		log.Printf("%s [%s]\n", b.URL, status)
-	}
-}
-
 // GetAttemptsFromContext returns the attempts for request
 func GetAttemptsFromContext(r *http.Request) int {
-	if attempts, ok := r.Context().Value(Attempts).(int); ok {
+	if attempts, ok := r.Context().Value(attemptsKey).(int); ok {
 		return attempts
 	}
 	return 1
@@ -117,14 +33,20 @@ func GetAttemptsFromContext(r *http.Request) int {
 
 // GetRetryFromContext returns the attempts for request
 func GetRetryFromContext(r *http.Request) int {
-	if retry, ok := r.Context().Value(Retry).(int); ok {
+	if retry, ok := r.Context().Value(retryKey).(int); ok {
 		return retry
 	}
 	return 0
 }
 
-// lb load balances the incoming request
+// lb load balances the incoming request to the pool routed by its Host header
 func lb(w http.ResponseWriter, r *http.Request) {
+	pool := router.PoolFor(r.Host)
+	if pool == nil {
+		http.NotFound(w, r)
+		return
+	}
+
 	attempts := GetAttemptsFromContext(r)
 	if attempts > 3 {
 		log.Printf("%s(%s) Max attempts reached, terminating\n", r.RemoteAddr, r.URL.Path)
@@ -132,15 +54,17 @@ func lb(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	peer := serverPool.GetNextPeer()
+	peer := pool.GetNextPeer(r)
 	if peer != nil {
+		peer.IncrementConnections()
+		defer peer.DecrementConnections()
 		peer.ReverseProxy.ServeHTTP(w, r)
 		return
 	}
 	http.Error(w, "Service not available", http.StatusServiceUnavailable)
 }
 
-// isAlive checks whether a backend is Alive by establishing a TCP connection
+// isBackendAlive checks whether a backend is Alive by establishing a TCP connection
 func isBackendAlive(u *url.URL) bool {
 	timeout := 2 * time.Second
 	conn, err := net.DialTimeout("tcp", u.Host, timeout)
@@ -152,97 +76,51 @@ func isBackendAlive(u *url.URL) bool {
 	return true
 }
 
-// healthCheck runs a routine for check status of the backends every 2 mins
-func healthCheck() {
-	t := time.NewTicker(time.Minute * 2)
-	for {
-		select {
-		case <-t.C:
-			log.Println("Starting health check...")
-			serverPool.HealthCheck()
-			log.Println("Health check completed")
-		}
-	}
-}
-
-var serverPool ServerPool
+// router is the currently active Router, mutated in place by the
+// ConfigManager as config.json changes so lb never needs to reach for a
+// lock around this variable itself.
+var router *Router
 
 func main() {
+	manager, err := NewConfigManager("config.json", NewHealthChecker())
+	if err != nil {
+		log.Fatal(err)
+	}
+	router = manager.Router()
+
+	config := manager.CurrentConfig()
 
-	var config Config = Config{
-		3030,
-		[]string{},
+	pollInterval := defaultConfigPollInterval
+	if config.ConfigPollSeconds > 0 {
+		pollInterval = time.Duration(config.ConfigPollSeconds) * time.Second
 	}
+	stop := make(chan struct{})
+	go manager.Watch(pollInterval, stop)
 
-	configString, err := ioutil.ReadFile("config.json")
-
-	if err == nil {
-		err = json.Unmarshal(configString, &config)
-
-		if err == nil {
-			if len(config.Backends) == 0 {
-				log.Fatal("Please provide one or more backends to load balance")
-			}
-
-			// used to wrap and generate context key
-			type contextKey string
-
-			// parse servers
-			tokens := config.Backends
-			for _, tok := range tokens {
-				serverURL, err := url.Parse(tok)
-				if err != nil {
-					log.Fatal(err)
-				}
-
-				proxy := httputil.NewSingleHostReverseProxy(serverURL)
-				proxy.ErrorHandler = func(writer http.ResponseWriter, request *http.Request, e error) {
-					log.Printf("[%s] %s\n", serverURL.Host, e.Error())
-					retries := GetRetryFromContext(request)
-					if retries < 3 {
-						select {
-						case <-time.After(10 * time.Millisecond):
-							ctx := context.WithValue(request.Context(), contextKey(Retry), retries+1)
-							proxy.ServeHTTP(writer, request.WithContext(ctx))
-						}
-						return
-					}
-
-					// after 3 retries, mark this backend as down
-					serverPool.MarkBackendStatus(serverURL, false)
-
-					// if the same request routing for few attempts with different backends, increase the count
-					attempts := GetAttemptsFromContext(request)
-					log.Printf("%s(%s) Attempting retry %d\n", request.RemoteAddr, request.URL.Path, attempts)
-					ctx := context.WithValue(request.Context(), contextKey(Attempts), attempts+1)
-					lb(writer, request.WithContext(ctx))
-				}
-
-				serverPool.AddBackend(&Backend{
-					URL:          serverURL,
-					Alive:        true,
-					ReverseProxy: proxy,
-				})
-				log.Printf("Configured server: %s\n", serverURL)
-			}
-
-			// create http server
-			server := http.Server{
-				Addr:    fmt.Sprintf(":%d", config.Port),
-				Handler: http.HandlerFunc(lb),
-			}
-
-			// start health checking
-			go healthCheck()
-
-			log.Printf("Load Balancer started at :%d\n", config.Port)
-			if err := server.ListenAndServe(); err != nil {
-				log.Fatal(err)
-			}
-		} else {
-			log.Fatal("Invalid configuration file")
+	adminPort := defaultAdminPort
+	if config.AdminPort > 0 {
+		adminPort = config.AdminPort
+	}
+	admin := NewAdminServer(manager)
+	go func() {
+		addr := fmt.Sprintf(":%d", adminPort)
+		log.Printf("Admin API listening at %s\n", addr)
+		if err := admin.ListenAndServe(addr); err != nil {
+			log.Fatal(err)
 		}
-	} else {
-		log.Fatal("Could not load configuration file")
+	}()
+
+	port := defaultPort
+	if config.Port > 0 {
+		port = config.Port
+	}
+	server := http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: http.HandlerFunc(lb),
+	}
+
+	log.Printf("Load Balancer started at :%d\n", port)
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatal(err)
 	}
 }
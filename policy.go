@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+// SelectionPolicy picks the next backend to serve a request from a pool
+// of currently alive backends. Implementations must be safe for
+// concurrent use.
+type SelectionPolicy interface {
+	NextPeer(s *ServerPool, r *http.Request) *Backend
+}
+
+// NewSelectionPolicy builds the SelectionPolicy named by policy. An empty
+// name defaults to round robin.
+func NewSelectionPolicy(policy string) (SelectionPolicy, error) {
+	switch policy {
+	case "", "round_robin":
+		return &RoundRobinPolicy{}, nil
+	case "weighted_round_robin":
+		return &WeightedRoundRobinPolicy{}, nil
+	case "least_conn":
+		return &LeastConnectionsPolicy{}, nil
+	case "random":
+		return &RandomPolicy{}, nil
+	case "ip_hash":
+		return &IPHashPolicy{}, nil
+	case "header":
+		return &HeaderPolicy{HeaderName: "X-Session-ID"}, nil
+	default:
+		return nil, fmt.Errorf("unknown selection policy %q", policy)
+	}
+}
+
+// aliveBackends returns the subset of the pool's backends that are
+// currently alive, in their original order.
+func aliveBackends(s *ServerPool) []*Backend {
+	backends := s.Backends()
+	alive := make([]*Backend, 0, len(backends))
+	for _, b := range backends {
+		if b.IsAlive() {
+			alive = append(alive, b)
+		}
+	}
+	return alive
+}
+
+// RoundRobinPolicy cycles through backends in order, skipping dead ones.
+type RoundRobinPolicy struct{}
+
+// NextPeer returns next active peer to take a connection
+func (p *RoundRobinPolicy) NextPeer(s *ServerPool, r *http.Request) *Backend {
+	backends := s.Backends()
+	if len(backends) == 0 {
+		return nil
+	}
+	next := s.NextIndex()
+	l := len(backends) + next // start from next and move a full cycle
+	for i := next; i < l; i++ {
+		idx := i % len(backends)     // take an index by modding
+		if backends[idx].IsAlive() { // if we have an alive backend, use it and store if its not the original one
+			if i != next {
+				atomic.StoreUint64(&s.current, uint64(idx))
+			}
+			return backends[idx]
+		}
+	}
+	return nil
+}
+
+// WeightedRoundRobinPolicy distributes requests across backends
+// proportionally to their configured Weight, using the smooth weighted
+// round-robin algorithm (as used by nginx upstream).
+type WeightedRoundRobinPolicy struct{}
+
+// NextPeer returns the next peer chosen by smooth weighted round-robin
+func (p *WeightedRoundRobinPolicy) NextPeer(s *ServerPool, r *http.Request) *Backend {
+	alive := aliveBackends(s)
+	if len(alive) == 0 {
+		return nil
+	}
+
+	s.wrrMux.Lock()
+	defer s.wrrMux.Unlock()
+
+	var best *Backend
+	total := 0
+	for _, b := range alive {
+		weight := b.GetWeight()
+		if weight <= 0 {
+			weight = 1
+		}
+		cur := s.wrrCurrent[b] + weight
+		s.wrrCurrent[b] = cur
+		total += weight
+		if best == nil || cur > s.wrrCurrent[best] {
+			best = b
+		}
+	}
+	s.wrrCurrent[best] -= total
+	return best
+}
+
+// LeastConnectionsPolicy sends each request to the alive backend with the
+// fewest in-flight requests.
+type LeastConnectionsPolicy struct{}
+
+// NextPeer returns the alive backend with the lowest active connection count
+func (p *LeastConnectionsPolicy) NextPeer(s *ServerPool, r *http.Request) *Backend {
+	var best *Backend
+	for _, b := range aliveBackends(s) {
+		if best == nil || b.ActiveConnections() < best.ActiveConnections() {
+			best = b
+		}
+	}
+	return best
+}
+
+// RandomPolicy picks a uniformly random alive backend.
+type RandomPolicy struct{}
+
+// NextPeer returns a random alive backend
+func (p *RandomPolicy) NextPeer(s *ServerPool, r *http.Request) *Backend {
+	alive := aliveBackends(s)
+	if len(alive) == 0 {
+		return nil
+	}
+	return alive[rand.Intn(len(alive))]
+}
+
+// IPHashPolicy consistently routes requests from the same client IP to the
+// same backend, as long as the set of alive backends is unchanged.
+type IPHashPolicy struct{}
+
+// NextPeer hashes the client IP against the alive backends
+func (p *IPHashPolicy) NextPeer(s *ServerPool, r *http.Request) *Backend {
+	return hashPeer(aliveBackends(s), clientIP(r))
+}
+
+// HeaderPolicy routes requests carrying the same value for HeaderName to
+// the same backend, which is useful for sticky sessions.
+type HeaderPolicy struct {
+	HeaderName string
+}
+
+// NextPeer hashes the configured header's value against the alive backends
+func (p *HeaderPolicy) NextPeer(s *ServerPool, r *http.Request) *Backend {
+	key := r.Header.Get(p.HeaderName)
+	return hashPeer(aliveBackends(s), key)
+}
+
+// hashPeer deterministically maps key onto one of the alive backends,
+// sorted by URL so the mapping is stable across calls.
+func hashPeer(alive []*Backend, key string) *Backend {
+	if len(alive) == 0 {
+		return nil
+	}
+	sorted := make([]*Backend, len(alive))
+	copy(sorted, alive)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].URL.String() < sorted[j].URL.String()
+	})
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	idx := int(h.Sum32() % uint32(len(sorted)))
+	return sorted[idx]
+}
+
+// clientIP extracts the client IP from a request, stripping the port if present.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+)
+
+// ServerPool holds information about reachable backends
+type ServerPool struct {
+	mux      sync.RWMutex
+	backends []*Backend
+	current  uint64
+	policy   SelectionPolicy
+
+	wrrMux     sync.Mutex
+	wrrCurrent map[*Backend]int
+}
+
+// NewServerPool creates a ServerPool using the given selection policy
+func NewServerPool(policy SelectionPolicy) *ServerPool {
+	return &ServerPool{
+		policy:     policy,
+		wrrCurrent: make(map[*Backend]int),
+	}
+}
+
+// AddBackend to the server pool
+func (s *ServerPool) AddBackend(backend *Backend) {
+	s.mux.Lock()
+	s.backends = append(s.backends, backend)
+	s.mux.Unlock()
+}
+
+// RemoveBackend takes a backend with the given URL out of rotation and
+// returns it, so the caller can drain it before closing it down. Reports
+// false if no such backend is in the pool.
+func (s *ServerPool) RemoveBackend(backendURL *url.URL) (*Backend, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for i, b := range s.backends {
+		if b.URL.String() == backendURL.String() {
+			s.backends = append(s.backends[:i], s.backends[i+1:]...)
+			s.wrrMux.Lock()
+			delete(s.wrrCurrent, b)
+			s.wrrMux.Unlock()
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+// Backends returns a snapshot of the backends currently in the pool
+func (s *ServerPool) Backends() []*Backend {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	out := make([]*Backend, len(s.backends))
+	copy(out, s.backends)
+	return out
+}
+
+// SetPolicy changes the selection policy used by GetNextPeer
+func (s *ServerPool) SetPolicy(policy SelectionPolicy) {
+	s.mux.Lock()
+	s.policy = policy
+	s.mux.Unlock()
+}
+
+// NextIndex atomically increase the counter and return an index
+func (s *ServerPool) NextIndex() int {
+	n := len(s.Backends())
+	if n == 0 {
+		return 0
+	}
+	return int(atomic.AddUint64(&s.current, uint64(1)) % uint64(n))
+}
+
+// GetNextPeer returns next active peer to take a connection, as chosen by
+// the pool's configured SelectionPolicy
+func (s *ServerPool) GetNextPeer(r *http.Request) *Backend {
+	s.mux.RLock()
+	policy := s.policy
+	s.mux.RUnlock()
+	return policy.NextPeer(s, r)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// Router dispatches an incoming request to the ServerPool configured for
+// its Host header, falling back to a "default" pool when the host has no
+// dedicated route. TLS SNI is not consulted.
+type Router struct {
+	mux   sync.RWMutex
+	pools map[string]*ServerPool
+}
+
+// NewRouter creates an empty Router
+func NewRouter() *Router {
+	return &Router{pools: make(map[string]*ServerPool)}
+}
+
+// AddPool registers pool as the target for host
+func (rt *Router) AddPool(host string, pool *ServerPool) {
+	rt.mux.Lock()
+	rt.pools[host] = pool
+	rt.mux.Unlock()
+}
+
+// RemovePool unregisters and returns host's pool, or nil if it had none
+func (rt *Router) RemovePool(host string) *ServerPool {
+	rt.mux.Lock()
+	defer rt.mux.Unlock()
+	pool := rt.pools[host]
+	delete(rt.pools, host)
+	return pool
+}
+
+// getPool returns host's pool with no fallback to "default"
+func (rt *Router) getPool(host string) *ServerPool {
+	rt.mux.RLock()
+	defer rt.mux.RUnlock()
+	return rt.pools[host]
+}
+
+// PoolFor returns the ServerPool for host, falling back to the "default"
+// pool if host has no dedicated route. Returns nil if neither exists.
+func (rt *Router) PoolFor(host string) *ServerPool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	rt.mux.RLock()
+	defer rt.mux.RUnlock()
+	if pool, ok := rt.pools[host]; ok {
+		return pool
+	}
+	return rt.pools["default"]
+}
+
+// Pools returns every ServerPool the router knows about, e.g. so callers
+// can start a HealthChecker for each one.
+func (rt *Router) Pools() []*ServerPool {
+	rt.mux.RLock()
+	defer rt.mux.RUnlock()
+	pools := make([]*ServerPool, 0, len(rt.pools))
+	for _, pool := range rt.pools {
+		pools = append(pools, pool)
+	}
+	return pools
+}
+
+// Hosts returns every host currently routed
+func (rt *Router) Hosts() []string {
+	rt.mux.RLock()
+	defer rt.mux.RUnlock()
+	hosts := make([]string, 0, len(rt.pools))
+	for host := range rt.pools {
+		hosts = append(hosts, host)
+	}
+	return hosts
+}